@@ -0,0 +1,208 @@
+// Package middleware provides a small set of commonly needed http.Handler
+// wrappers (access logging, gzip compression, panic recovery and request
+// IDs) for use with dotweb.Config.Middleware.
+package middleware
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// responseWriter wraps an http.ResponseWriter to capture the status code
+// and number of bytes written, so wrapping middlewares can report on them
+// after the handler has run.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// AccessLog returns a middleware that writes one NCSA Combined Log Format
+// line per request to w, e.g.:
+//
+// 	127.0.0.1 - - [10/Oct/2020:13:55:36 +0000] "GET / HTTP/1.1" 200 1234 "-" "curl/7.64.1"
+func AccessLog(w io.Writer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			crw := &responseWriter{ResponseWriter: rw}
+			next.ServeHTTP(crw, r)
+			if crw.status == 0 {
+				crw.status = http.StatusOK
+			}
+
+			referer := r.Referer()
+			if referer == "" {
+				referer = "-"
+			}
+			userAgent := r.UserAgent()
+			if userAgent == "" {
+				userAgent = "-"
+			}
+
+			fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"\n",
+				remoteAddr(r),
+				start.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method, r.RequestURI, r.Proto,
+				crw.status, crw.bytes,
+				referer, userAgent,
+			)
+		})
+	}
+}
+
+// remoteAddr strips the port from r.RemoteAddr, falling back to the raw
+// value if it cannot be split.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Gzip returns a middleware that compresses the response body with gzip
+// at the given compression level if the client advertises support for it
+// via the Accept-Encoding header. Responses that are already encoded, or
+// whose status carries no body (204, 304), are left untouched.
+func Gzip(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			grw := &gzipResponseWriter{ResponseWriter: w, level: level}
+			defer grw.Close()
+			next.ServeHTTP(grw, r)
+		})
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter lazily gzips the response body, deciding whether to
+// compress only once the status code for the response is known: 204/304
+// responses and responses that already declare a Content-Encoding are
+// passed through unmodified instead of being wrapped in a gzip stream.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level       int
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if status != http.StatusNoContent && status != http.StatusNotModified &&
+		w.Header().Get("Content-Encoding") == "" {
+		if gz, err := gzip.NewWriterLevel(w.ResponseWriter, w.level); err == nil {
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+			w.gz = gz
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Close flushes and closes the underlying gzip.Writer, if one was opened.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+// Recover returns a middleware that turns panics in the wrapped handler
+// into a 500 response, logging the recovered value and a stack trace
+// instead of crashing the process.
+func Recover() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					log.Printf("panic handling %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestIDKey is the context key RequestID stores the generated ID under.
+type requestIDKey struct{}
+
+// RequestID returns a middleware that assigns each request a unique ID,
+// exposing it via the X-Request-ID header and through RequestIDFromContext.
+func RequestID() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := newRequestID()
+			w.Header().Set("X-Request-ID", id)
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequestIDFromContext returns the request ID set by RequestID, or "" if
+// none is present.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID generates a random 16-byte hex-encoded ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x", b)
+}
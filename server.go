@@ -1,14 +1,28 @@
 package dotweb
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KeKsBoTer/dotweb/middleware"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// Middleware wraps an http.Handler to add behaviour (logging, compression,
+// recovery, ...) before and/or after the wrapped handler runs.
+type Middleware func(http.Handler) http.Handler
+
 // Config provides config values for the webserver
 type Config struct {
 
@@ -17,21 +31,106 @@ type Config struct {
 	// e.g. dotcookie.me, www.dotcookie.me
 	Host string `json:"host"`
 
-	// Port defines the port to listen on for HTTP requests
-	Port int `json:"port"`
+	// HttpPort defines the port to listen on for HTTP requests
+	HttpPort int `json:"httpPort"`
+
+	// HttpsPort defines the port to listen on for HTTPS requests.
+	// Only used if CertsDir is set.
+	HttpsPort int `json:"httpsPort"`
+
+	// CertsDir is the directory used to cache certificates obtained
+	// via Let's Encrypt. If left empty, HTTPS is not served.
+	CertsDir string `json:"certsDir"`
+
+	// RedirectHttp redirects all plain HTTP requests to HTTPS.
+	// Only takes effect if CertsDir is set.
+	RedirectHttp bool `json:"redirectHttp"`
+
+	// Domains are the hostnames certificates may be requested for.
+	// Required if CertsDir is set.
+	Domains []string `json:"domains"`
+
+	// AccessLog is where Combined Log Format access log lines are written.
+	// Valid values are a file path, "stdout", "stderr" or "off" (default).
+	AccessLog string `json:"accessLog"`
 
 	// DB is the connection string for database
 	DB string `json:"db"`
 
-	// The function that handles all incoming HTTP and HTTPS requests
+	// StaticDir, if set, is served as static files under StaticPrefix.
+	StaticDir string `json:"staticDir"`
+
+	// StaticPrefix is the path StaticDir is mounted at. Defaults to "/".
+	StaticPrefix string `json:"staticPrefix"`
+
+	// Routes registers additional handlers by path. Entries are registered
+	// on the same mux as StaticDir, so both can be used together.
+	Routes map[string]http.Handler `json:"-"`
+
+	// Middleware are applied around Handler, in order, with the first
+	// entry becoming the outermost wrapper. Use Config.Use to append to it.
+	Middleware []Middleware `json:"-"`
+
+	// ShutdownTimeout is how long in-flight requests are given to finish
+	// after a shutdown signal before the server is forcibly stopped.
+	// Given as a duration string (e.g. "30s") in JSON. Defaults to 30s.
+	ShutdownTimeout time.Duration `json:"-"`
+
+	// The function that handles all incoming HTTP and HTTPS requests.
+	// If StaticDir or Routes is set, Handler is used as the fallback for
+	// anything not matched by them. If RedirectHttp takes effect, plain
+	// HTTP requests are redirected to HTTPS instead of reaching Handler.
 	Handler http.HandlerFunc `json:"-"`
 }
 
+// MarshalJSON implements json.Marshaler, encoding ShutdownTimeout as a
+// duration string (e.g. "30s") instead of a plain integer of nanoseconds.
+func (c Config) MarshalJSON() ([]byte, error) {
+	type alias Config
+	return json.Marshal(struct {
+		alias
+		ShutdownTimeout string `json:"shutdownTimeout"`
+	}{
+		alias:           alias(c),
+		ShutdownTimeout: c.ShutdownTimeout.String(),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, parsing ShutdownTimeout from
+// a duration string (e.g. "30s") via time.ParseDuration.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type alias Config
+	aux := struct {
+		alias
+		ShutdownTimeout string `json:"shutdownTimeout"`
+	}{}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*c = Config(aux.alias)
+	if len(aux.ShutdownTimeout) > 0 {
+		d, err := time.ParseDuration(aux.ShutdownTimeout)
+		if err != nil {
+			return err
+		}
+		c.ShutdownTimeout = d
+	}
+	return nil
+}
+
+// Use appends the given middlewares to Config.Middleware, in order.
+func (c *Config) Use(mw ...Middleware) {
+	c.Middleware = append(c.Middleware, mw...)
+}
+
 // DefaultConfig provides the default configurations
 func DefaultConfig() Config {
 	return Config{
-		Host: "",
-		Port: 80,
+		Host:            "",
+		HttpPort:        80,
+		StaticPrefix:    "/",
+		RedirectHttp:    true,
+		ShutdownTimeout: 30 * time.Second,
 	}
 }
 
@@ -47,34 +146,79 @@ func DefaultConfig() Config {
 //   path to json config file, overrides flags
 // -host string
 //   hostname to listen on. Leave blank to listen for localhost
-// -port int
+// -http int
 //   port to listen on for HTTP requests (default 80)
-// -RedirectHTTP
+// -https int
+//   port to listen on for HTTPS requests
+// -certsDir string
+//   directory to cache Let's Encrypt certificates in, enables HTTPS
+// -redirectHttp
 //   redirect all HTTP requests to HTTPS (default true)
+// -domains string
+//   comma separated list of domains to request certificates for
+// -accessLog string
+//   path to write Combined Log Format access logs to, or "stdout"/"stderr"/"off" (default "off")
+// -static string
+//   directory to serve static files from
+// -staticPrefix string
+//   path to mount the static file server at (default "/")
+// -noGenerateConfig
+//   don't write a default config file when -config points to a missing file
 func ConfigFromFlags(args []string) (*Config, error) {
 	defaultConfig := DefaultConfig()
 	flags := flag.NewFlagSet("dotweb", flag.ContinueOnError)
 	host := flags.String("host", defaultConfig.Host, "hostname to listen on. Leave blank to listen for localhost")
-	port := flags.Int("port", defaultConfig.Port, "port to listen on for HTTP requests")
+	httpPort := flags.Int("http", defaultConfig.HttpPort, "port to listen on for HTTP requests")
+	httpsPort := flags.Int("https", defaultConfig.HttpsPort, "port to listen on for HTTPS requests")
+	certsDir := flags.String("certsDir", defaultConfig.CertsDir, "directory to cache Let's Encrypt certificates in, enables HTTPS")
+	redirectHttp := flags.Bool("redirectHttp", defaultConfig.RedirectHttp, "redirect all HTTP requests to HTTPS")
+	domains := flags.String("domains", "", "comma separated list of domains to request certificates for")
+	accessLog := flags.String("accessLog", defaultConfig.AccessLog, `path to write access logs to, or "stdout"/"stderr"/"off"`)
+	static := flags.String("static", defaultConfig.StaticDir, "directory to serve static files from")
+	staticPrefix := flags.String("staticPrefix", defaultConfig.StaticPrefix, "path to mount the static file server at")
 	db := flags.String("db", defaultConfig.DB, "database connection string")
 	configFile := flags.String("config", "", "path to json config file, overrides flags")
+	noGenerateConfig := flags.Bool("noGenerateConfig", false, "don't write a default config file when -config points to a missing file")
 	err := flags.Parse(args)
 	if err != nil {
 		return nil, err
 	}
 	if len(*configFile) > 0 {
-		return loadConfig(*configFile)
+		return loadConfig(*configFile, !*noGenerateConfig)
+	}
+	var domainList []string
+	if len(*domains) > 0 {
+		domainList = strings.Split(*domains, ",")
 	}
 	return &Config{
-		Host: *host,
-		Port: *port,
-		DB:   *db,
+		Host:            *host,
+		HttpPort:        *httpPort,
+		HttpsPort:       *httpsPort,
+		CertsDir:        *certsDir,
+		RedirectHttp:    *redirectHttp,
+		Domains:         domainList,
+		AccessLog:       *accessLog,
+		StaticDir:       *static,
+		StaticPrefix:    *staticPrefix,
+		DB:              *db,
+		ShutdownTimeout: defaultConfig.ShutdownTimeout,
 	}, nil
 }
 
 // Load config from json file
 // Path is the location of the file
-func loadConfig(path string) (*Config, error) {
+// If generateIfMissing is true and no file exists at path, a default
+// config is generated there first, so first-run users get a working,
+// editable config without hunting for field names.
+func loadConfig(path string, generateIfMissing bool) (*Config, error) {
+	if generateIfMissing {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := generateDefaultConfig(path); err != nil {
+				return nil, err
+			}
+			log.Println("no config file found at", path, "- generated a default one")
+		}
+	}
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -87,10 +231,21 @@ func loadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
+// generateDefaultConfig writes DefaultConfig(), marshaled as indented
+// JSON, to path.
+func generateDefaultConfig(path string) error {
+	data, err := json.MarshalIndent(DefaultConfig(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
 // StartWebServerFromConfig starts a webserver and provides the configuration via json file.
+// If configFile does not exist, a default config is generated there first.
 // See dotweb.StartWebServer(dotweb.Config) for further explanations
 func StartWebServerFromConfig(configFile string, handler http.HandlerFunc) error {
-	config, err := loadConfig(configFile)
+	config, err := loadConfig(configFile, true)
 	if err != nil {
 		return err
 	}
@@ -98,17 +253,192 @@ func StartWebServerFromConfig(configFile string, handler http.HandlerFunc) error
 	return StartWebServer(*config)
 }
 
-// StartWebServer starts a webserver with the given configurations
+// StartWebServer starts a webserver with the given configurations and
+// shuts it down gracefully on SIGINT/SIGTERM, giving in-flight requests
+// up to config.ShutdownTimeout to finish.
 // See dotweb.Config for configuration options
 // If config.CertsDir is empty HTTPS will not be available
 //
 // All incomminng requests on HTTP and HTTPS port will be directed to config.Handler
 func StartWebServer(config Config) error {
-	port := ":" + strconv.Itoa(config.Port)
-	httpServer := http.Server{
-		Addr:    config.Host + ":" + strconv.Itoa(config.Port),
-		Handler: config.Handler,
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	return StartWebServerContext(ctx, config)
+}
+
+// StartWebServerContext starts a webserver like StartWebServer, but shuts
+// it down when ctx is cancelled instead of listening for OS signals. This
+// allows dotweb to be embedded in larger applications and enables clean
+// teardown in tests.
+func StartWebServerContext(ctx context.Context, config Config) error {
+	handler, err := buildHandler(config)
+	if err != nil {
+		return err
+	}
+
+	shutdownTimeout := config.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+
+	httpAddr := config.Host + ":" + strconv.Itoa(config.HttpPort)
+	httpServer := &http.Server{
+		Addr:    httpAddr,
+		Handler: handler,
+	}
+	servers := []*http.Server{httpServer}
+
+	errs := make(chan error, 2)
+
+	if len(config.CertsDir) == 0 {
+		go func() {
+			log.Println("starting listening on", httpAddr)
+			errs <- httpServer.ListenAndServe()
+		}()
+	} else {
+		manager := autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(config.CertsDir),
+			HostPolicy: autocert.HostWhitelist(config.Domains...),
+		}
+
+		httpsAddr := config.Host + ":" + strconv.Itoa(config.HttpsPort)
+		httpsServer := &http.Server{
+			Addr:      httpsAddr,
+			Handler:   handler,
+			TLSConfig: manager.TLSConfig(),
+		}
+		servers = append(servers, httpsServer)
+
+		var httpHandler http.Handler
+		if config.RedirectHttp {
+			httpHandler = redirectHandler(config.HttpsPort)
+		} else {
+			httpHandler = handler
+		}
+		httpServer.Handler = manager.HTTPHandler(httpHandler)
+
+		go func() {
+			log.Println("starting listening on", httpAddr)
+			errs <- httpServer.ListenAndServe()
+		}()
+		go func() {
+			log.Println("starting listening on", httpsAddr, "(https)")
+			errs <- httpsServer.ListenAndServeTLS("", "")
+		}()
+	}
+
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = nil
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if srv.Shutdown(shutdownCtx) != nil {
+			srv.Close()
+		}
+	}
+	return err
+}
+
+// buildHandler wraps config.Handler with config.Middleware (outermost
+// entry first) plus any middleware implied by other config fields, such
+// as AccessLog.
+func buildHandler(config Config) (http.Handler, error) {
+	var handler http.Handler = config.Handler
+
+	if len(config.StaticDir) > 0 || len(config.Routes) > 0 {
+		handler = buildMux(config)
+	}
+
+	for i := len(config.Middleware) - 1; i >= 0; i-- {
+		handler = config.Middleware[i](handler)
+	}
+
+	if len(config.AccessLog) > 0 && config.AccessLog != "off" {
+		w, err := accessLogWriter(config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		handler = middleware.AccessLog(w)(handler)
+	}
+
+	return handler, nil
+}
+
+// buildMux registers config.Routes and the config.StaticDir file server on
+// an http.ServeMux, falling back to config.Handler for anything else. If a
+// Routes entry already claims the pattern StaticDir/Handler would use,
+// that entry wins instead of panicking on a duplicate registration.
+func buildMux(config Config) http.Handler {
+	mux := http.NewServeMux()
+	for pattern, handler := range config.Routes {
+		mux.Handle(pattern, handler)
+	}
+
+	prefix := config.StaticPrefix
+	if len(prefix) == 0 {
+		prefix = "/"
+	}
+	// http.ServeMux only treats patterns ending in "/" as subtrees, so the
+	// mounted pattern needs a trailing slash even if StaticPrefix doesn't
+	// have one; StripPrefix then uses the un-suffixed prefix to strip it.
+	pattern := prefix
+	if !strings.HasSuffix(pattern, "/") {
+		pattern += "/"
+	}
+	_, prefixTakenByRoute := config.Routes[pattern]
+	rootTaken := false
+	if len(config.StaticDir) > 0 && !prefixTakenByRoute {
+		fileServer := http.FileServer(http.Dir(config.StaticDir))
+		mux.Handle(pattern, http.StripPrefix(strings.TrimSuffix(prefix, "/"), fileServer))
+		rootTaken = pattern == "/"
+	}
+
+	_, rootTakenByRoute := config.Routes["/"]
+	if config.Handler != nil && !rootTaken && !rootTakenByRoute {
+		mux.Handle("/", config.Handler)
+	}
+	return mux
+}
+
+// accessLogWriter resolves an AccessLog config value to the io.Writer
+// access log lines should be written to.
+func accessLogWriter(accessLog string) (io.Writer, error) {
+	switch accessLog {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	default:
+		return os.OpenFile(accessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+}
+
+// redirectHandler redirects all non-ACME-challenge requests to the HTTPS
+// URL of the same host and path, listening on httpsPort.
+func redirectHandler(httpsPort int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if i := strings.Index(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		if httpsPort != 443 {
+			host = host + ":" + strconv.Itoa(httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
 	}
-	log.Println("starting listening on", config.Host+port)
-	return httpServer.ListenAndServe()
 }
@@ -1,6 +1,7 @@
 package dotweb
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -45,7 +46,7 @@ func TestLoadConfig(t *testing.T) {
 		if err != nil {
 			t.Fatal("failed to create config file:", err)
 		}
-		loadedConfig, err := loadConfig(fileName)
+		loadedConfig, err := loadConfig(fileName, false)
 		if err != nil {
 			t.Fatal("failed to load config file:", err)
 		}
@@ -60,6 +61,8 @@ func TestLoadConfig(t *testing.T) {
 }
 
 func TestStartWebServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
 		config, err := ConfigFromFlags([]string{
 			"-http=8080", "-redirectHttp=false",
@@ -74,7 +77,7 @@ func TestStartWebServer(t *testing.T) {
 		config.Handler = func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprint(w, "It works")
 		}
-		err = StartWebServer(*config)
+		err = StartWebServerContext(ctx, *config)
 		if err != nil {
 			log.Fatal(err)
 		}